@@ -6,6 +6,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
+
 	"github.com/hashicorp/consul/agent/cache"
 	"github.com/hashicorp/consul/agent/local"
 	"github.com/hashicorp/consul/agent/structs"
@@ -41,7 +43,11 @@ type Manager struct {
 
 	mu       sync.Mutex
 	proxies  map[string]*state
-	watchers map[string]map[uint64]chan *ConfigSnapshot
+	watchers map[string]map[uint64]*watcher
+	// nextWatchIdx is a monotonically increasing counter used to key watchers
+	// so that indexes are never reused even after earlier watchers are
+	// removed - len(watchers) would collide here since indexes aren't dense.
+	nextWatchIdx uint64
 }
 
 // ManagerConfig holds the required external dependencies for a Manager
@@ -60,6 +66,23 @@ type ManagerConfig struct {
 	Source *structs.QuerySource
 	// logger is the agent's logger to be used for logging logs.
 	Logger *log.Logger
+	// DataDir is the agent's data directory, used to persist the latest
+	// ConfigSnapshot for each proxy to disk so that Watch can serve it
+	// immediately across an agent restart while the cache re-warms. Leaving
+	// this unset disables persistence entirely.
+	DataDir string
+	// Transformers is an ordered chain of SnapshotTransformers run over every
+	// ConfigSnapshot before it's delivered to watchers or persisted. It's the
+	// extension point used to add enterprise-only snapshot enrichment without
+	// forking state.go. Leaving this unset runs no transforms. Transformers is
+	// only read once, at NewManager time - there's no hot-reload path, so
+	// changing it requires constructing a new Manager.
+	Transformers []SnapshotTransformer
+	// WatcherDeadline is how long a Watch consumer is allowed to fall behind
+	// on draining its channel before the manager evicts it as a slow
+	// consumer - see watcher in watch.go. Leaving this unset (zero) uses
+	// watcherDeadline.
+	WatcherDeadline time.Duration
 }
 
 // NewManager constructs a manager from the provided agent cache.
@@ -74,7 +97,7 @@ func NewManager(cfg ManagerConfig) (*Manager, error) {
 		// is "level triggering" and we can't miss actual data.
 		stateCh:  make(chan struct{}, 1),
 		proxies:  make(map[string]*state),
-		watchers: make(map[string]map[uint64]chan *ConfigSnapshot),
+		watchers: make(map[string]map[uint64]*watcher),
 	}
 	return m, nil
 }
@@ -174,7 +197,18 @@ func (m *Manager) ensureProxyServiceLocked(ns *structs.NodeService, token string
 	go func(ch <-chan ConfigSnapshot) {
 		// Run until ch is closed
 		for snap := range ch {
-			m.notify(&snap)
+			transformed, err := m.applyTransformers(&snap)
+			if err != nil {
+				m.cfg.Logger.Printf("[ERR] failed to transform config snapshot for %s: %s",
+					snap.ProxyID, err)
+				continue
+			}
+
+			m.notify(transformed)
+			if err := persistSnapshot(m.cfg.DataDir, transformed.ProxyID, transformed); err != nil {
+				m.cfg.Logger.Printf("[WARN] failed to persist config snapshot for %s: %s",
+					transformed.ProxyID, err)
+			}
 		}
 	}(ch)
 
@@ -193,6 +227,7 @@ func (m *Manager) removeProxyServiceLocked(proxyID string) {
 	// watch chan is closed.
 	state.Close()
 	delete(m.proxies, proxyID)
+	deletePersistedSnapshot(m.cfg.DataDir, proxyID)
 
 	// We intentionally leave potential watchers hanging here - there is no new
 	// config for them and closing their channels might be indistinguishable from
@@ -210,46 +245,67 @@ func (m *Manager) notify(snap *ConfigSnapshot) {
 		return
 	}
 
-	for _, ch := range watchers {
-		// Attempt delivery but don't let slow consumers block us forever. They
-		// might miss updates but it's better than breaking everything.
-		//
-		// TODO(banks): should we close their chan here to force them to eventually
-		// notice they are too slow? Not sure if it really helps.
-		select {
-		case ch <- snap:
-		case <-time.After(100 * time.Millisecond):
-		}
+	metrics.SetGaugeWithLabels([]string{"proxycfg", "watch", "count"}, float32(len(watchers)),
+		[]metrics.Label{{Name: "proxy_id", Value: snap.ProxyID}})
+
+	for _, w := range watchers {
+		// Hand off to the watcher's own goroutine which coalesces updates and
+		// evicts the consumer if it falls too far behind rather than blocking
+		// us, the state goroutine, or any other watcher.
+		w.sendUpdate(snap)
 	}
 }
 
 // Watch registers a watch on a proxy. It might not exist yet in which case this
 // will not fail, but no updates will be delivered until the proxy is
 // registered. If there is already a valid snapshot in memory, it will be
-// delivered immediately.
+// delivered immediately. Failing that, if a recent snapshot was persisted to
+// disk (see ManagerConfig.DataDir) before the agent's last restart, that is
+// delivered immediately instead while the real snapshot re-warms in the
+// background.
 func (m *Manager) Watch(proxyID string) (<-chan *ConfigSnapshot, CancelFunc) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 
-	// This buffering is crucial otherwise we'd block immediately trying to
-	// deliver the current snapshot below if we already have one.
-	ch := make(chan *ConfigSnapshot, 1)
+	deadline := m.cfg.WatcherDeadline
+	if deadline == 0 {
+		deadline = watcherDeadline
+	}
+	w := newWatcherWithDeadline(proxyID, deadline)
 	watchers, ok := m.watchers[proxyID]
 	if !ok {
-		watchers = make(map[uint64]chan *ConfigSnapshot)
+		watchers = make(map[uint64]*watcher)
 	}
-	idx := uint64(len(watchers))
-	watchers[idx] = ch
+	idx := m.nextWatchIdx
+	m.nextWatchIdx++
+	watchers[idx] = w
 	m.watchers[proxyID] = watchers
 
-	// Deliver the current snapshot immediately if there is one ready
+	var currentSnap *ConfigSnapshot
 	if state, ok := m.proxies[proxyID]; ok {
-		if snap := state.CurrentSnapshot(); snap != nil {
-			ch <- snap
+		currentSnap = state.CurrentSnapshot()
+	}
+	dataDir := m.cfg.DataDir
+
+	m.mu.Unlock()
+
+	// Deliver the current snapshot immediately if there is one ready, falling
+	// back to the last one persisted to disk before a restart. The disk read
+	// in loadPersistedSnapshot is done with the lock released above so that a
+	// slow disk can't serialize every other proxy's Watch/notify/Close behind
+	// it.
+	if currentSnap != nil {
+		transformed, err := m.applyTransformers(currentSnap)
+		if err != nil {
+			m.cfg.Logger.Printf("[ERR] failed to transform config snapshot for %s: %s",
+				proxyID, err)
+		} else {
+			w.sendUpdate(transformed)
 		}
+	} else if snap := loadPersistedSnapshot(dataDir, proxyID); snap != nil {
+		w.sendUpdate(snap)
 	}
 
-	return ch, func() {
+	return w.ch, func() {
 		m.mu.Lock()
 		defer m.mu.Unlock()
 		m.closeWatchLocked(proxyID, idx)
@@ -260,9 +316,9 @@ func (m *Manager) Watch(proxyID string) (<-chan *ConfigSnapshot, CancelFunc) {
 // lock is held.
 func (m *Manager) closeWatchLocked(proxyID string, watchIdx uint64) {
 	if watchers, ok := m.watchers[proxyID]; ok {
-		if ch, ok := watchers[watchIdx]; ok {
+		if w, ok := watchers[watchIdx]; ok {
 			delete(watchers, watchIdx)
-			close(ch)
+			w.close()
 			if len(watchers) == 0 {
 				delete(m.watchers, proxyID)
 			}
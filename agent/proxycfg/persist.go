@@ -0,0 +1,111 @@
+package proxycfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedSnapshotMaxAge is how long a snapshot written to disk is trusted
+// as a warm starting point after an agent restart before it's considered
+// too stale to be useful and is discarded instead of being served.
+const persistedSnapshotMaxAge = 1 * time.Hour
+
+// persistedSnapshot is the on-disk envelope around a ConfigSnapshot. It
+// carries its own timestamp rather than relying on the file's mtime since
+// that doesn't reliably survive copies or backups.
+type persistedSnapshot struct {
+	StoredAt time.Time
+	Snapshot *ConfigSnapshot
+}
+
+// snapshotCacheDir returns the directory the manager persists snapshots
+// under inside the given agent data dir.
+func snapshotCacheDir(dataDir string) string {
+	return filepath.Join(dataDir, "proxycfg-snapshots")
+}
+
+// snapshotFilePath returns the on-disk path for the given proxy's persisted
+// snapshot. proxyID is a service ID which may contain characters that are
+// awkward in file names so we hex-encode it rather than trust it directly.
+func snapshotFilePath(dataDir, proxyID string) string {
+	return filepath.Join(snapshotCacheDir(dataDir), fmt.Sprintf("%x.json", proxyID))
+}
+
+// isSnapshotValid reports whether snap has finished its initial warm-up
+// (Roots and Leaf are populated). A snapshot taken before that point has no
+// TLS material, and the xDS layer treats missing Roots/Leaf as "don't
+// terminate TLS" - so persisting or serving a partial snapshot would let a
+// warm restart hand Envoy a cert-less, non-mTLS listener. Better to fall
+// through to a real cache re-warm than serve that.
+func isSnapshotValid(snap *ConfigSnapshot) bool {
+	return snap != nil && snap.Roots != nil && snap.Leaf != nil
+}
+
+// persistSnapshot writes snap to disk so that Watch can serve it immediately
+// after an agent restart, before the cache has re-warmed. dataDir being
+// empty disables persistence entirely, and so does snap not yet having
+// completed its initial warm-up - see isSnapshotValid. Errors are not fatal -
+// persistence is a best-effort optimization, not a correctness requirement,
+// so callers should log and carry on rather than fail.
+func persistSnapshot(dataDir, proxyID string, snap *ConfigSnapshot) error {
+	if dataDir == "" || !isSnapshotValid(snap) {
+		return nil
+	}
+	if err := os.MkdirAll(snapshotCacheDir(dataDir), 0700); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(persistedSnapshot{StoredAt: time.Now(), Snapshot: snap})
+	if err != nil {
+		return err
+	}
+
+	path := snapshotFilePath(dataDir, proxyID)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadPersistedSnapshot returns the last snapshot persisted for proxyID, or
+// nil if there isn't one, it can't be read, it's older than
+// persistedSnapshotMaxAge, or it never finished its initial warm-up (see
+// isSnapshotValid) - the last check is defense in depth alongside the same
+// guard in persistSnapshot, in case an older on-disk file predates it.
+func loadPersistedSnapshot(dataDir, proxyID string) *ConfigSnapshot {
+	if dataDir == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(snapshotFilePath(dataDir, proxyID))
+	if err != nil {
+		return nil
+	}
+
+	var ps persistedSnapshot
+	if err := json.Unmarshal(buf, &ps); err != nil {
+		return nil
+	}
+	if time.Since(ps.StoredAt) > persistedSnapshotMaxAge {
+		return nil
+	}
+	if !isSnapshotValid(ps.Snapshot) {
+		return nil
+	}
+	return ps.Snapshot
+}
+
+// deletePersistedSnapshot removes any snapshot persisted for proxyID, e.g.
+// once the proxy is deregistered so a stale snapshot can't come back from
+// the dead if a different service later reuses the same ID.
+func deletePersistedSnapshot(dataDir, proxyID string) {
+	if dataDir == "" {
+		return
+	}
+	os.Remove(snapshotFilePath(dataDir, proxyID))
+}
@@ -0,0 +1,116 @@
+package proxycfg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// validSnapshot returns a ConfigSnapshot that's finished its initial
+// warm-up, i.e. one isSnapshotValid accepts.
+func validSnapshot(proxyID string) *ConfigSnapshot {
+	return &ConfigSnapshot{
+		ProxyID: proxyID,
+		Roots:   &structs.IndexedCARoots{},
+		Leaf:    &structs.IssuedCert{},
+	}
+}
+
+func TestPersistSnapshot_RoundTrip(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "proxycfg-persist-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	want := validSnapshot("web-sidecar-proxy")
+
+	if err := persistSnapshot(dataDir, want.ProxyID, want); err != nil {
+		t.Fatalf("persistSnapshot failed: %s", err)
+	}
+
+	got := loadPersistedSnapshot(dataDir, want.ProxyID)
+	if got == nil {
+		t.Fatalf("expected a persisted snapshot, got nil")
+	}
+	if got.ProxyID != want.ProxyID {
+		t.Fatalf("got ProxyID %q, want %q", got.ProxyID, want.ProxyID)
+	}
+}
+
+func TestPersistSnapshot_DisabledWithoutDataDir(t *testing.T) {
+	if err := persistSnapshot("", "web", validSnapshot("web")); err != nil {
+		t.Fatalf("expected persisting with no DataDir to be a silent no-op, got: %s", err)
+	}
+	if got := loadPersistedSnapshot("", "web"); got != nil {
+		t.Fatalf("expected no persisted snapshot without a DataDir, got %+v", got)
+	}
+}
+
+// TestPersistSnapshot_SkipsPartialSnapshot guards against persisting (and
+// later serving) a snapshot that hasn't finished its initial warm-up: the
+// xDS layer treats missing Roots/Leaf as "don't terminate TLS", so doing so
+// would let a warm restart hand Envoy a cert-less, non-mTLS listener.
+func TestPersistSnapshot_SkipsPartialSnapshot(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "proxycfg-persist-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	partial := &ConfigSnapshot{ProxyID: "web-sidecar-proxy"}
+	if err := persistSnapshot(dataDir, partial.ProxyID, partial); err != nil {
+		t.Fatalf("persistSnapshot failed: %s", err)
+	}
+
+	if got := loadPersistedSnapshot(dataDir, partial.ProxyID); got != nil {
+		t.Fatalf("expected a partial (no Roots/Leaf) snapshot not to be persisted, got %+v", got)
+	}
+}
+
+func TestLoadPersistedSnapshot_MissingIsNil(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "proxycfg-persist-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	if got := loadPersistedSnapshot(dataDir, "never-registered"); got != nil {
+		t.Fatalf("expected nil for a proxy that was never persisted, got %+v", got)
+	}
+}
+
+func TestLoadPersistedSnapshot_StaleIsDiscarded(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "proxycfg-persist-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	proxyID := "web-sidecar-proxy"
+	if err := persistSnapshot(dataDir, proxyID, validSnapshot(proxyID)); err != nil {
+		t.Fatalf("persistSnapshot failed: %s", err)
+	}
+
+	// Rewrite the file with a StoredAt far enough in the past to have aged
+	// out, simulating an agent that's been down well past the TTL.
+	stale := persistedSnapshot{
+		StoredAt: time.Now().Add(-2 * persistedSnapshotMaxAge),
+		Snapshot: validSnapshot(proxyID),
+	}
+	buf, err := json.Marshal(stale)
+	if err != nil {
+		t.Fatalf("failed to marshal stale snapshot: %s", err)
+	}
+	if err := ioutil.WriteFile(snapshotFilePath(dataDir, proxyID), buf, 0600); err != nil {
+		t.Fatalf("failed to write stale snapshot: %s", err)
+	}
+
+	if got := loadPersistedSnapshot(dataDir, proxyID); got != nil {
+		t.Fatalf("expected a stale persisted snapshot to be discarded, got %+v", got)
+	}
+}
@@ -0,0 +1,52 @@
+package proxycfg
+
+import "errors"
+
+// errNilTransformedSnapshot is returned by applyTransformers when a
+// SnapshotTransformer returns a nil snapshot without an error - treated the
+// same as any other transform error so a misbehaving transformer can't crash
+// the state goroutine by fanning out a nil *ConfigSnapshot.
+var errNilTransformedSnapshot = errors.New("snapshot transformer returned a nil snapshot")
+
+// SnapshotTransformer is the extension point for logic that needs to
+// observe or modify every ConfigSnapshot between it being produced by a
+// proxy's state and being fanned out to watchers (and persisted to disk).
+// It lets enterprise features and third-party integrations - for example
+// injecting default upstreams from central config, applying per-proxy
+// overrides stored in the KV store, or redacting fields for RBAC - extend
+// the manager without needing to fork state.go.
+type SnapshotTransformer interface {
+	// Transform is called with each ConfigSnapshot before it's delivered.
+	// Implementations may mutate snap in place and return it, or return a
+	// different *ConfigSnapshot entirely. Returning a non-nil error aborts
+	// delivery of that snapshot entirely - the error is logged and watchers
+	// simply don't receive an update for it.
+	Transform(snap *ConfigSnapshot) (*ConfigSnapshot, error)
+}
+
+// applyTransformers runs cfg.Transformers over snap in order, short
+// circuiting and returning the first error encountered. With no
+// transformers configured it's a no-op that returns snap unchanged.
+//
+// This runs synchronously on the per-proxy goroutine that also delivers to
+// watchers and persists to disk (see ensureProxyServiceLocked), so a slow or
+// hung Transform blocks both for that one proxy - it does not have its own
+// timeout and none is enforced here. Transformers are expected to be fast,
+// local, in-memory operations; anything that might block (a network call, a
+// lock shared with other proxies) should bound its own work and fail fast
+// rather than relying on a caller-imposed deadline. Other proxies are
+// unaffected since each has its own goroutine.
+
+func (m *Manager) applyTransformers(snap *ConfigSnapshot) (*ConfigSnapshot, error) {
+	var err error
+	for _, t := range m.cfg.Transformers {
+		snap, err = t.Transform(snap)
+		if err != nil {
+			return nil, err
+		}
+		if snap == nil {
+			return nil, errNilTransformedSnapshot
+		}
+	}
+	return snap, nil
+}
@@ -0,0 +1,118 @@
+package proxycfg
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordingTransformer appends its name to order and optionally mutates or
+// fails, to let tests assert both ordering and short-circuit behaviour.
+type recordingTransformer struct {
+	name    string
+	order   *[]string
+	err     error
+	nilSnap bool
+}
+
+func (t *recordingTransformer) Transform(snap *ConfigSnapshot) (*ConfigSnapshot, error) {
+	*t.order = append(*t.order, t.name)
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.nilSnap {
+		return nil, nil
+	}
+	return snap, nil
+}
+
+func TestApplyTransformers_NoneConfigured(t *testing.T) {
+	m := &Manager{}
+	snap := &ConfigSnapshot{ProxyID: "web"}
+
+	got, err := m.applyTransformers(snap)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got != snap {
+		t.Fatalf("expected snap to be returned unchanged")
+	}
+}
+
+func TestApplyTransformers_RunInOrder(t *testing.T) {
+	var order []string
+	m := &Manager{
+		cfg: ManagerConfig{
+			Transformers: []SnapshotTransformer{
+				&recordingTransformer{name: "first", order: &order},
+				&recordingTransformer{name: "second", order: &order},
+				&recordingTransformer{name: "third", order: &order},
+			},
+		},
+	}
+
+	got, err := m.applyTransformers(&ConfigSnapshot{ProxyID: "web"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got == nil {
+		t.Fatalf("expected a non-nil snapshot")
+	}
+
+	want := []string{"first", "second", "third"}
+	if len(order) != len(want) {
+		t.Fatalf("got order %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestApplyTransformers_ErrorAbortsChain(t *testing.T) {
+	var order []string
+	boom := errors.New("boom")
+	m := &Manager{
+		cfg: ManagerConfig{
+			Transformers: []SnapshotTransformer{
+				&recordingTransformer{name: "first", order: &order},
+				&recordingTransformer{name: "second", order: &order, err: boom},
+				&recordingTransformer{name: "third", order: &order},
+			},
+		},
+	}
+
+	got, err := m.applyTransformers(&ConfigSnapshot{ProxyID: "web"})
+	if err != boom {
+		t.Fatalf("got err %v, want %v", err, boom)
+	}
+	if got != nil {
+		t.Fatalf("expected a nil snapshot on error, got %+v", got)
+	}
+	if len(order) != 2 {
+		t.Fatalf("expected the chain to stop after the failing transformer, got %v", order)
+	}
+}
+
+func TestApplyTransformers_NilSnapshotIsAnError(t *testing.T) {
+	var order []string
+	m := &Manager{
+		cfg: ManagerConfig{
+			Transformers: []SnapshotTransformer{
+				&recordingTransformer{name: "first", order: &order, nilSnap: true},
+				&recordingTransformer{name: "second", order: &order},
+			},
+		},
+	}
+
+	got, err := m.applyTransformers(&ConfigSnapshot{ProxyID: "web"})
+	if err != errNilTransformedSnapshot {
+		t.Fatalf("got err %v, want %v", err, errNilTransformedSnapshot)
+	}
+	if got != nil {
+		t.Fatalf("expected a nil snapshot, got %+v", got)
+	}
+	if len(order) != 1 {
+		t.Fatalf("expected the chain to stop after the nil-returning transformer, got %v", order)
+	}
+}
@@ -0,0 +1,122 @@
+package proxycfg
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// watcherDeadline is the default amount of time a watcher is allowed to sit
+// on an undelivered snapshot before it's considered a slow consumer and
+// evicted. It's deliberately generous since a connect proxy reloading its
+// config is not latency sensitive the way a data plane request is.
+const watcherDeadline = 10 * time.Second
+
+// watcher manages delivery of ConfigSnapshots for a single call to
+// Manager.Watch. It coalesces updates - if the consumer hasn't caught up by
+// the time a new snapshot arrives, the old one is discarded in favour of the
+// newest one - and evicts (closes the channel) any consumer that doesn't
+// drain a snapshot within its deadline (watcherDeadline by default).
+type watcher struct {
+	proxyID string
+
+	// ch is the buffered channel handed back to the caller of Manager.Watch.
+	ch chan *ConfigSnapshot
+
+	// updateCh is used internally to hand the latest snapshot to the
+	// delivery goroutine. It's always kept at depth 0 or 1 - sendUpdate
+	// overwrites whatever is currently buffered rather than blocking.
+	updateCh chan *ConfigSnapshot
+
+	// doneCh is closed by the Manager when the watch is cancelled.
+	doneCh chan struct{}
+
+	// deadline is how long run will wait for ch to drain before evicting.
+	// Manager.Watch sets it from ManagerConfig.WatcherDeadline, or
+	// watcherDeadline when that is unset; tests set it much shorter to avoid
+	// a slow test suite.
+	deadline time.Duration
+}
+
+// newWatcher creates and starts a watcher for proxyID. The caller is
+// responsible for calling close() once the watch is cancelled.
+func newWatcher(proxyID string) *watcher {
+	return newWatcherWithDeadline(proxyID, watcherDeadline)
+}
+
+func newWatcherWithDeadline(proxyID string, deadline time.Duration) *watcher {
+	w := &watcher{
+		proxyID:  proxyID,
+		deadline: deadline,
+		// Single item buffer is enough since updates are coalesced - only
+		// the most recent snapshot matters, and the watcher always has it.
+		ch:       make(chan *ConfigSnapshot, 1),
+		updateCh: make(chan *ConfigSnapshot, 1),
+		doneCh:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// sendUpdate hands snap to the watcher's delivery goroutine without
+// blocking. If the watcher hasn't consumed a previous update yet, that
+// update is dropped in favour of snap since only the latest snapshot
+// matters to a consumer that reloads its whole config from it.
+func (w *watcher) sendUpdate(snap *ConfigSnapshot) {
+	labels := []metrics.Label{{Name: "proxy_id", Value: w.proxyID}}
+
+	for {
+		select {
+		case w.updateCh <- snap:
+			metrics.SetGaugeWithLabels([]string{"proxycfg", "watch", "queue", "depth"}, 1, labels)
+			return
+		default:
+		}
+
+		// Buffer is full with a stale snapshot, drain it and retry. We loop
+		// rather than assume the racy drain succeeds first try.
+		select {
+		case <-w.updateCh:
+			metrics.IncrCounterWithLabels([]string{"proxycfg", "watch", "coalesce"}, 1, labels)
+		default:
+		}
+	}
+}
+
+// run delivers snapshots from updateCh to ch, evicting the consumer if it
+// falls more than its deadline behind. run is the sole owner of ch: it's
+// the only goroutine that ever closes it, via the defer below, so there's no
+// way to race a send against a close of the same channel.
+func (w *watcher) run() {
+	defer close(w.ch)
+
+	labels := []metrics.Label{{Name: "proxy_id", Value: w.proxyID}}
+
+	for {
+		select {
+		case snap := <-w.updateCh:
+			select {
+			case w.ch <- snap:
+				metrics.SetGaugeWithLabels([]string{"proxycfg", "watch", "queue", "depth"}, 0, labels)
+			case <-time.After(w.deadline):
+				metrics.IncrCounterWithLabels([]string{"proxycfg", "watch", "evicted"}, 1, labels)
+				return
+			case <-w.doneCh:
+				return
+			}
+
+		case <-w.doneCh:
+			return
+		}
+	}
+}
+
+// close stops the watcher's delivery goroutine, which closes ch itself once
+// it observes doneCh - see run. Calling close is how a normal,
+// caller-initiated cancellation is signalled; an eviction due to a slow
+// consumer closes ch for the same underlying reason (run returning), so a
+// consumer that sees ch close without ever calling its CancelFunc knows it
+// was evicted, or that the whole Manager was closed, rather than cancelled.
+func (w *watcher) close() {
+	close(w.doneCh)
+}
@@ -0,0 +1,82 @@
+package proxycfg
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWatcherCancelRace exercises sendUpdate racing against close: run's ch
+// close (run is sole owner, see watch.go) must never overlap an in-flight
+// send on the same channel, which would panic. Run with -race to catch a
+// regression of that bug.
+func TestWatcherCancelRace(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		w := newWatcher("web")
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				w.sendUpdate(&ConfigSnapshot{ProxyID: "web"})
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			w.close()
+		}()
+
+		wg.Wait()
+
+		// Draining ch must never panic regardless of whether we observe a
+		// delivered snapshot or the channel closing first.
+		for range w.ch {
+		}
+	}
+}
+
+// TestWatcherEviction verifies a consumer that never drains ch gets evicted
+// (ch is closed) once it falls behind by more than the watcher's deadline.
+func TestWatcherEviction(t *testing.T) {
+	deadline := 10 * time.Millisecond
+	w := newWatcherWithDeadline("web", deadline)
+	defer w.close()
+
+	// The first update fills ch's single buffer slot since ch starts out
+	// empty; we wait for run to move it there so the second update can't
+	// coalesce it away while it's still in updateCh. The second has nowhere
+	// to go - run blocks trying to deliver it until we evict past deadline,
+	// since we never read from ch.
+	w.sendUpdate(&ConfigSnapshot{ProxyID: "web"})
+	for start := time.Now(); len(w.ch) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("timed out waiting for first update to reach ch")
+		}
+	}
+	w.sendUpdate(&ConfigSnapshot{ProxyID: "web"})
+
+	time.Sleep(deadline * 5)
+
+	// Draining a closed channel first yields whatever was already buffered,
+	// then a final (nil, false) once it's empty - that's the eviction signal.
+	select {
+	case _, ok := <-w.ch:
+		if !ok {
+			t.Fatalf("expected the first buffered snapshot before eviction, got closed instead")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for buffered update")
+	}
+
+	select {
+	case _, ok := <-w.ch:
+		if ok {
+			t.Fatalf("expected ch to be closed (evicted) after buffered value drained")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for watcher to evict slow consumer")
+	}
+}
@@ -0,0 +1,132 @@
+package xds
+
+import (
+	"fmt"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_api_v2_auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	envoy_api_v2_core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// localAppClusterName is the name given to the cluster representing the
+// proxy's own local application instance that inbound connections are
+// ultimately forwarded to.
+const localAppClusterName = "local_app"
+
+// defaultLocalServiceAddress is used for the local_app cluster when the
+// registered service has no LocalServiceAddress set, which is the common
+// case - most services don't bother setting it since they're always
+// reachable via loopback from their own sidecar. An empty address would
+// otherwise produce an invalid (Envoy-NACKed) STATIC cluster.
+const defaultLocalServiceAddress = "127.0.0.1"
+
+// clustersFromSnapshot translates each of the proxy's upstreams, plus its
+// own local application, into Envoy Cluster resources (CDS). Upstream
+// clusters use EDS for their membership since that set changes independently
+// of cluster config; the local app cluster is a static, single-endpoint
+// STATIC cluster since it's always just the sidecar's loopback.
+func (g *generator) clustersFromSnapshot(snap *proxycfg.ConfigSnapshot) ([]*types.Any, error) {
+	clusters := make([]*envoy_api_v2.Cluster, 0, len(snap.Proxy.Upstreams)+1)
+
+	localAddr := snap.Proxy.LocalServiceAddress
+	if localAddr == "" {
+		localAddr = defaultLocalServiceAddress
+	}
+
+	clusters = append(clusters, &envoy_api_v2.Cluster{
+		Name:           localAppClusterName,
+		ConnectTimeout: types.DurationProto(defaultClusterConnectTimeout),
+		ClusterDiscoveryType: &envoy_api_v2.Cluster_Type{
+			Type: envoy_api_v2.Cluster_STATIC,
+		},
+		LoadAssignment: makeLoadAssignment(localAppClusterName, []resolvedEndpoint{
+			{address: localAddr, port: uint32(snap.Proxy.LocalServicePort)},
+		}),
+	})
+
+	upstreamTLS, err := makeUpstreamTLSContext(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range snap.Proxy.Upstreams {
+		name := u.Identifier()
+		clusters = append(clusters, &envoy_api_v2.Cluster{
+			Name:           name,
+			ConnectTimeout: types.DurationProto(defaultClusterConnectTimeout),
+			ClusterDiscoveryType: &envoy_api_v2.Cluster_Type{
+				Type: envoy_api_v2.Cluster_EDS,
+			},
+			EdsClusterConfig: &envoy_api_v2.Cluster_EdsClusterConfig{
+				EdsConfig: &envoy_api_v2_core.ConfigSource{
+					ConfigSourceSpecifier: &envoy_api_v2_core.ConfigSource_Ads{
+						Ads: &envoy_api_v2_core.AggregatedConfigSource{},
+					},
+				},
+			},
+			TlsContext: upstreamTLS,
+		})
+	}
+
+	return toAnySlice(clusters)
+}
+
+// makeUpstreamTLSContext builds the UpstreamTlsContext used to present the
+// proxy's leaf certificate and validate the upstream's leaf certificate
+// against the known CA roots, i.e. mutual TLS between two Connect proxies.
+// It returns nil (no TLS) if the snapshot doesn't have CA/leaf data yet -
+// that just means the proxy hasn't finished its initial warm-up and Envoy
+// will get a real TLS context on the next DiscoveryResponse.
+func makeUpstreamTLSContext(snap *proxycfg.ConfigSnapshot) (*envoy_api_v2_auth.UpstreamTlsContext, error) {
+	if snap.Roots == nil || snap.Leaf == nil {
+		return nil, nil
+	}
+	common, err := makeCommonTLSContext(snap)
+	if err != nil {
+		return nil, err
+	}
+	return &envoy_api_v2_auth.UpstreamTlsContext{
+		CommonTlsContext: common,
+	}, nil
+}
+
+// makeCommonTLSContext builds the TLS material shared between upstream and
+// downstream TLS contexts: our own identity (leaf cert/key) plus the trusted
+// CA roots used to validate the peer.
+func makeCommonTLSContext(snap *proxycfg.ConfigSnapshot) (*envoy_api_v2_auth.CommonTlsContext, error) {
+	return &envoy_api_v2_auth.CommonTlsContext{
+		TlsParams: &envoy_api_v2_auth.TlsParameters{},
+		TlsCertificates: []*envoy_api_v2_auth.TlsCertificate{
+			{
+				CertificateChain: inlineString(snap.Leaf.CertPEM),
+				PrivateKey:       inlineString(snap.Leaf.PrivateKeyPEM),
+			},
+		},
+		ValidationContextType: &envoy_api_v2_auth.CommonTlsContext_ValidationContext{
+			ValidationContext: &envoy_api_v2_auth.CertificateValidationContext{
+				TrustedCa: inlineString(snap.Roots.ConcatenatedRootPEMs()),
+			},
+		},
+	}, nil
+}
+
+func inlineString(s string) *envoy_api_v2_core.DataSource {
+	return &envoy_api_v2_core.DataSource{
+		Specifier: &envoy_api_v2_core.DataSource_InlineString{InlineString: s},
+	}
+}
+
+func toAnySlice(clusters []*envoy_api_v2.Cluster) ([]*types.Any, error) {
+	resources := make([]*types.Any, 0, len(clusters))
+	for _, c := range clusters {
+		a, err := types.MarshalAny(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal cluster %s: %s", c.Name, err)
+		}
+		resources = append(resources, a)
+	}
+	return resources, nil
+}
@@ -0,0 +1,90 @@
+package xds
+
+import (
+	"time"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_api_v2_core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoy_api_v2_endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/gogo/protobuf/types"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// defaultClusterConnectTimeout is used for every cluster we generate since
+// nothing in a ConfigSnapshot currently lets an operator tune it per
+// upstream.
+const defaultClusterConnectTimeout = 5 * time.Second
+
+// resolvedEndpoint is the address/port pair of a single healthy instance
+// backing a cluster, independent of where it came from (the local app,
+// catalog service discovery, a prepared query, ...).
+type resolvedEndpoint struct {
+	address string
+	port    uint32
+}
+
+// endpointsFromSnapshot translates the healthy instances Consul has
+// discovered for each upstream into Envoy ClusterLoadAssignment resources
+// (EDS). The local app cluster's endpoint is static so it's built directly
+// into its Cluster by clustersFromSnapshot rather than advertised here.
+func (g *generator) endpointsFromSnapshot(snap *proxycfg.ConfigSnapshot) ([]*types.Any, error) {
+	resources := make([]*types.Any, 0, len(snap.Proxy.Upstreams))
+
+	for _, u := range snap.Proxy.Upstreams {
+		name := u.Identifier()
+
+		nodes := snap.UpstreamEndpoints[name]
+		endpoints := make([]resolvedEndpoint, 0, len(nodes))
+		for _, n := range nodes {
+			addr := n.Service.Address
+			if addr == "" {
+				addr = n.Node.Address
+			}
+			endpoints = append(endpoints, resolvedEndpoint{
+				address: addr,
+				port:    uint32(n.Service.Port),
+			})
+		}
+
+		a, err := types.MarshalAny(makeLoadAssignment(name, endpoints))
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, a)
+	}
+
+	return resources, nil
+}
+
+// makeLoadAssignment builds a ClusterLoadAssignment containing one LbEndpoint
+// per resolved upstream instance, all in a single, unnamed locality - we
+// don't yet do any locality-aware routing.
+func makeLoadAssignment(clusterName string, endpoints []resolvedEndpoint) *envoy_api_v2.ClusterLoadAssignment {
+	lbEndpoints := make([]*envoy_api_v2_endpoint.LbEndpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		lbEndpoints = append(lbEndpoints, &envoy_api_v2_endpoint.LbEndpoint{
+			HostIdentifier: &envoy_api_v2_endpoint.LbEndpoint_Endpoint{
+				Endpoint: &envoy_api_v2_endpoint.Endpoint{
+					Address: &envoy_api_v2_core.Address{
+						Address: &envoy_api_v2_core.Address_SocketAddress{
+							SocketAddress: &envoy_api_v2_core.SocketAddress{
+								Address: ep.address,
+								PortSpecifier: &envoy_api_v2_core.SocketAddress_PortValue{
+									PortValue: ep.port,
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+
+	return &envoy_api_v2.ClusterLoadAssignment{
+		ClusterName: clusterName,
+		Endpoints: []*envoy_api_v2_endpoint.LocalityLbEndpoints{
+			{LbEndpoints: lbEndpoints},
+		},
+	}
+}
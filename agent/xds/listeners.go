@@ -0,0 +1,134 @@
+package xds
+
+import (
+	"fmt"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_api_v2_auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	envoy_api_v2_core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoy_api_v2_listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	envoy_tcp_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/gogo/protobuf/types"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// publicListenerName is the name of the single inbound listener every
+// connect-proxy gets, regardless of how many upstreams it has.
+const publicListenerName = "public_listener"
+
+// defaultPublicBindAddress is used for the public listener when the proxy
+// registration didn't set an explicit Address. Unlike the local_app cluster,
+// which only ever needs to be reached by its own sidecar, the public
+// listener has to accept mTLS connections from other Connect proxies on the
+// network, so it defaults to all interfaces rather than loopback. An empty
+// address would otherwise produce an invalid (Envoy-NACKed) listener.
+const defaultPublicBindAddress = "0.0.0.0"
+
+// listenersFromSnapshot builds the public (mTLS terminating) inbound
+// listener plus one outbound listener per upstream (LDS). Every listener
+// just wraps a TCP proxy filter pointed at the matching cluster - L7 routing
+// features (HTTP-aware upstreams, RDS) aren't implemented yet so there's no
+// HTTP connection manager filter here.
+func (g *generator) listenersFromSnapshot(snap *proxycfg.ConfigSnapshot) ([]*types.Any, error) {
+	listeners := make([]*envoy_api_v2.Listener, 0, len(snap.Proxy.Upstreams)+1)
+
+	downstreamTLS, err := makeDownstreamTLSContext(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	bindAddr := snap.Address
+	if bindAddr == "" {
+		bindAddr = defaultPublicBindAddress
+	}
+
+	public, err := makeTCPProxyListener(publicListenerName, bindAddr, uint32(snap.Port),
+		localAppClusterName, downstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, public)
+
+	for _, u := range snap.Proxy.Upstreams {
+		name := u.Identifier()
+		l, err := makeTCPProxyListener(name, u.LocalBindAddress, uint32(u.LocalBindPort), name, nil)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	resources := make([]*types.Any, 0, len(listeners))
+	for _, l := range listeners {
+		a, err := types.MarshalAny(l)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal listener %s: %s", l.Name, err)
+		}
+		resources = append(resources, a)
+	}
+	return resources, nil
+}
+
+// makeTCPProxyListener builds a Listener bound to addr:port that proxies all
+// traffic to clusterName via a plain TCP proxy filter, optionally wrapped in
+// a downstream TLS context (used only for the public listener, which
+// terminates mTLS from other Connect proxies).
+func makeTCPProxyListener(name, addr string, port uint32, clusterName string, tls *envoy_api_v2_auth.DownstreamTlsContext) (*envoy_api_v2.Listener, error) {
+	tcpProxy := &envoy_tcp_proxy.TcpProxy{
+		StatPrefix: name,
+		ClusterSpecifier: &envoy_tcp_proxy.TcpProxy_Cluster{
+			Cluster: clusterName,
+		},
+	}
+	filterCfg, err := types.MarshalAny(tcpProxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tcp_proxy filter for %s: %s", name, err)
+	}
+
+	l := &envoy_api_v2.Listener{
+		Name: name,
+		Address: &envoy_api_v2_core.Address{
+			Address: &envoy_api_v2_core.Address_SocketAddress{
+				SocketAddress: &envoy_api_v2_core.SocketAddress{
+					Address: addr,
+					PortSpecifier: &envoy_api_v2_core.SocketAddress_PortValue{
+						PortValue: port,
+					},
+				},
+			},
+		},
+		FilterChains: []*envoy_api_v2_listener.FilterChain{
+			{
+				TlsContext: tls,
+				Filters: []*envoy_api_v2_listener.Filter{
+					{
+						Name: "envoy.tcp_proxy",
+						ConfigType: &envoy_api_v2_listener.Filter_TypedConfig{
+							TypedConfig: filterCfg,
+						},
+					},
+				},
+			},
+		},
+	}
+	return l, nil
+}
+
+// makeDownstreamTLSContext builds the DownstreamTlsContext the public
+// listener uses to require and verify a client (peer Connect proxy)
+// certificate against our known CA roots. Like makeUpstreamTLSContext, nil
+// is returned (no TLS) until the snapshot has CA/leaf data.
+func makeDownstreamTLSContext(snap *proxycfg.ConfigSnapshot) (*envoy_api_v2_auth.DownstreamTlsContext, error) {
+	if snap.Roots == nil || snap.Leaf == nil {
+		return nil, nil
+	}
+	common, err := makeCommonTLSContext(snap)
+	if err != nil {
+		return nil, err
+	}
+	return &envoy_api_v2_auth.DownstreamTlsContext{
+		CommonTlsContext:         common,
+		RequireClientCertificate: &types.BoolValue{Value: true},
+	}, nil
+}
@@ -0,0 +1,112 @@
+package xds
+
+import (
+	"fmt"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// xDS type URLs for the v2 discovery API.
+const (
+	ListenerType = "type.googleapis.com/envoy.api.v2.Listener"
+	RouteType    = "type.googleapis.com/envoy.api.v2.RouteConfiguration"
+	ClusterType  = "type.googleapis.com/envoy.api.v2.Cluster"
+	EndpointType = "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment"
+)
+
+// generator translates proxycfg.ConfigSnapshots into Envoy xDS
+// DiscoveryResponses, keeping track of the version/nonce per resource type so
+// that each ADS stream can do incremental ACK/NACK tracking.
+type generator struct {
+	// versions and pending are both keyed by type URL. versions is the
+	// monotonic counter used to stamp both VersionInfo and Nonce on every
+	// response of that type - Envoy requires a distinct nonce per response.
+	// pending records the nonce of the most recent response sent of that
+	// type so ack can recognise (and ignore) a stale ACK/NACK for a response
+	// we've since superseded.
+	versions map[string]uint64
+	pending  map[string]string
+}
+
+func newGenerator() *generator {
+	return &generator{
+		versions: make(map[string]uint64),
+		pending:  make(map[string]string),
+	}
+}
+
+// ack checks an (N)ACK from Envoy against the response we last sent for
+// typeURL; it doesn't change any state. It returns an error if nonce doesn't match the most recent nonce we sent,
+// which happens when a new response for that type superseded it before the
+// ACK arrived - per the xDS protocol such a stale ACK/NACK should just be
+// ignored rather than treated as a stream error.
+func (g *generator) ack(typeURL, nonce string) error {
+	// Envoy's very first request for each type has no nonce at all since it
+	// hasn't received a response yet - that's the initial subscription, not an
+	// ACK, so there's nothing to validate.
+	if nonce == "" {
+		return nil
+	}
+	want, ok := g.pending[typeURL]
+	if !ok || nonce != want {
+		return fmt.Errorf("stale or unknown nonce %q for %s, ignoring", nonce, typeURL)
+	}
+	return nil
+}
+
+// allResources builds one DiscoveryResponse per xDS resource type Envoy has
+// actually subscribed to (see subscribed in process), in CDS/EDS/LDS/RDS
+// order which is the order Envoy expects them on initial bootstrap of an ADS
+// stream. A type Envoy hasn't subscribed to is skipped entirely rather than
+// sent with zero resources - that matters most for RDS, which is always
+// empty today since routesFromSnapshot has nothing to generate yet (see its
+// doc comment), and would otherwise be pushed to every proxy regardless of
+// whether it even uses HTTP upstreams.
+func (g *generator) allResources(snap *proxycfg.ConfigSnapshot, subscribed map[string]bool) ([]*envoy_api_v2.DiscoveryResponse, error) {
+	clusters, err := g.clustersFromSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := g.endpointsFromSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := g.listenersFromSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := g.routesFromSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []*envoy_api_v2.DiscoveryResponse
+	if subscribed[ClusterType] {
+		responses = append(responses, g.makeResponse(ClusterType, clusters))
+	}
+	if subscribed[EndpointType] {
+		responses = append(responses, g.makeResponse(EndpointType, endpoints))
+	}
+	if subscribed[ListenerType] {
+		responses = append(responses, g.makeResponse(ListenerType, listeners))
+	}
+	if subscribed[RouteType] && len(routes) > 0 {
+		responses = append(responses, g.makeResponse(RouteType, routes))
+	}
+	return responses, nil
+}
+
+func (g *generator) makeResponse(typeURL string, resources []*types.Any) *envoy_api_v2.DiscoveryResponse {
+	g.versions[typeURL]++
+	nonce := fmt.Sprintf("%d", g.versions[typeURL])
+	g.pending[typeURL] = nonce
+	return &envoy_api_v2.DiscoveryResponse{
+		TypeUrl:     typeURL,
+		VersionInfo: nonce,
+		Nonce:       nonce,
+		Resources:   resources,
+	}
+}
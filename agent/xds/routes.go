@@ -0,0 +1,19 @@
+package xds
+
+import (
+	"github.com/gogo/protobuf/types"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// routesFromSnapshot builds RouteConfiguration resources (RDS) for upstreams
+// that need HTTP-aware routing rather than a plain TCP proxy filter.
+//
+// Every upstream today gets an inline TCP proxy filter set directly on its
+// listener by listenersFromSnapshot, so there's nothing for RDS to serve yet.
+// This is intentionally scoped out of the initial translation rather than
+// unimplemented: HTTP-aware upstreams (and the per-upstream protocol config
+// needed to tell them apart from plain TCP ones) are a separate follow up.
+func (g *generator) routesFromSnapshot(snap *proxycfg.ConfigSnapshot) ([]*types.Any, error) {
+	return nil, nil
+}
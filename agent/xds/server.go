@@ -0,0 +1,181 @@
+// Package xds provides an implementation of Envoy's xDS (v2) Aggregated
+// Discovery Service (ADS) that is driven directly off the proxycfg.Manager
+// rather than needing a separate control plane. This lets operators run
+// stock Envoy as a Connect sidecar by pointing it at the local agent's gRPC
+// port instead of using consul-connect's built in proxy.
+//
+// Wiring this up requires the agent to construct a Server from its
+// proxycfg.Manager and call Register on the gRPC server it listens with,
+// alongside (not instead of) the existing HTTP/DNS listeners - that call site
+// lives in the agent's top level startup code, which isn't part of this
+// package and isn't present in this checkout.
+package xds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_discovery_v2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// ADSStream is a shorthand alias for the stream protobuf interface the
+// ADS implementation speaks. It uses the v2 discovery API types only; the v3
+// API is not served.
+type ADSStream interface {
+	Send(*envoy_api_v2.DiscoveryResponse) error
+	Recv() (*envoy_api_v2.DiscoveryRequest, error)
+}
+
+// Watcher is the subset of *proxycfg.Manager that Server depends on. It's
+// pulled out as an interface so tests can supply a fake set of snapshots
+// without needing to construct a real proxycfg.Manager (which in turn needs
+// a live agent cache and local state).
+type Watcher interface {
+	Watch(proxyID string) (<-chan *proxycfg.ConfigSnapshot, proxycfg.CancelFunc)
+}
+
+// Server represents a gRPC server that exposes xDS to Envoy proxies. Each
+// Envoy connects with a single ADS stream and requests LDS/RDS/CDS/EDS
+// resources for its proxy ID which we translate from the corresponding
+// proxycfg.ConfigSnapshot.
+type Server struct {
+	Logger *log.Logger
+
+	// CfgMgr resolves snapshots for connected Envoy proxies - normally a
+	// *proxycfg.Manager.
+	CfgMgr Watcher
+
+	// activeStreams is used purely for observability/testing to track how many
+	// concurrent ADS streams are currently being served.
+	activeStreams int64
+}
+
+// NewServer creates a new xDS server instance.
+func NewServer(cfgMgr Watcher, logger *log.Logger) *Server {
+	return &Server{
+		Logger: logger,
+		CfgMgr: cfgMgr,
+	}
+}
+
+// Register registers the ADS gRPC service implementation on the given
+// *grpc.Server.
+func (s *Server) Register(srv *grpc.Server) {
+	envoy_discovery_v2.RegisterAggregatedDiscoveryServiceServer(srv, s)
+}
+
+// StreamAggregatedResources implements
+// envoy_discovery_v2.AggregatedDiscoveryServiceServer. It is the single
+// entry point for all xDS resource types multiplexed over one stream.
+func (s *Server) StreamAggregatedResources(stream envoy_discovery_v2.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	atomic.AddInt64(&s.activeStreams, 1)
+	defer atomic.AddInt64(&s.activeStreams, -1)
+
+	return s.process(stream)
+}
+
+// process drives a single ADS stream until the client disconnects or an
+// unrecoverable error occurs.
+func (s *Server) process(stream ADSStream) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// reqCh carries incoming DiscoveryRequests (including ACK/NACKs) off of the
+	// blocking Recv call so we can select on them alongside snapshot updates.
+	reqCh := make(chan *envoy_api_v2.DiscoveryRequest, 1)
+	go func() {
+		defer close(reqCh)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case reqCh <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		proxyID     string
+		watchCh     <-chan *proxycfg.ConfigSnapshot
+		watchCancel proxycfg.CancelFunc
+	)
+
+	// subscribed tracks which xDS type URLs Envoy has actually asked for on
+	// this stream, keyed by TypeUrl. Every DiscoveryRequest - the initial
+	// subscription as well as every later ACK/NACK - carries the type it's
+	// for, so this fills in as requests arrive and is used to avoid pushing
+	// resource types Envoy never asked for (notably RDS, which is otherwise
+	// always empty - see allResources).
+	subscribed := make(map[string]bool)
+	defer func() {
+		if watchCancel != nil {
+			watchCancel()
+		}
+	}()
+
+	gen := newGenerator()
+
+	for {
+		select {
+		case req, ok := <-reqCh:
+			if !ok {
+				return nil
+			}
+
+			// Envoy only populates Node on the very first request of a stream;
+			// every ACK/NACK that follows omits it. Only the first request needs
+			// it - that's what tells us which proxy this stream is for - so we
+			// must not reject later, nodeless requests.
+			if proxyID == "" {
+				if req.Node == nil || req.Node.Id == "" {
+					return errors.New("xds: first discovery request is missing a node id")
+				}
+				proxyID = req.Node.Id
+				watchCh, watchCancel = s.CfgMgr.Watch(proxyID)
+			}
+
+			subscribed[req.TypeUrl] = true
+
+			if req.ErrorDetail != nil {
+				s.Logger.Printf("[WARN] xds: envoy rejected %s config for %s: %s",
+					req.TypeUrl, proxyID, req.ErrorDetail.Message)
+				continue
+			}
+			if err := gen.ack(req.TypeUrl, req.ResponseNonce); err != nil {
+				// A mismatched nonce means this ACK/NACK is for a response we've
+				// since superseded - Envoy's own protocol docs say these should be
+				// ignored rather than treated as a stream error.
+				s.Logger.Printf("[DEBUG] xds: %s", err)
+				continue
+			}
+
+		case snap, ok := <-watchCh:
+			if !ok {
+				return fmt.Errorf("xds: config snapshot watch closed for %s", proxyID)
+			}
+			resources, err := gen.allResources(snap, subscribed)
+			if err != nil {
+				return err
+			}
+			for _, res := range resources {
+				if err := stream.Send(res); err != nil {
+					return err
+				}
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package xds
+
+import (
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_api_v2_core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"github.com/hashicorp/consul/agent/proxycfg"
+)
+
+// errStreamClosed is what fakeStream.Recv returns once its request channel
+// is closed, standing in for the real io.EOF/grpc status a live stream would
+// return when Envoy disconnects.
+var errStreamClosed = errors.New("fake stream closed")
+
+// waitForSend polls until stream has sent at least n responses or times out
+// failing the test - process runs in its own goroutine in these tests so we
+// can't just assert on stream.sent synchronously after feeding a request.
+func waitForSend(t *testing.T, stream *fakeStream, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if len(stream.sent) >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d sent responses, got %d", n, len(stream.sent))
+}
+
+func timeoutCh() <-chan time.Time {
+	return time.After(time.Second)
+}
+
+// fakeWatcher is a test double for Watcher that serves a fixed, closeable
+// channel of snapshots rather than requiring a real proxycfg.Manager.
+type fakeWatcher struct {
+	ch         chan *proxycfg.ConfigSnapshot
+	cancelled  bool
+	proxyIDGot string
+}
+
+func (f *fakeWatcher) Watch(proxyID string) (<-chan *proxycfg.ConfigSnapshot, proxycfg.CancelFunc) {
+	f.proxyIDGot = proxyID
+	return f.ch, func() { f.cancelled = true }
+}
+
+// fakeStream is a test double for ADSStream backed by Go channels instead of
+// a real gRPC connection.
+type fakeStream struct {
+	reqs  chan *envoy_api_v2.DiscoveryRequest
+	sent  []*envoy_api_v2.DiscoveryResponse
+	recvd int
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{reqs: make(chan *envoy_api_v2.DiscoveryRequest, 10)}
+}
+
+func (f *fakeStream) Send(r *envoy_api_v2.DiscoveryResponse) error {
+	f.sent = append(f.sent, r)
+	return nil
+}
+
+func (f *fakeStream) Recv() (*envoy_api_v2.DiscoveryRequest, error) {
+	req, ok := <-f.reqs
+	if !ok {
+		return nil, errStreamClosed
+	}
+	f.recvd++
+	return req, nil
+}
+
+func testServer() (*Server, *fakeWatcher) {
+	w := &fakeWatcher{ch: make(chan *proxycfg.ConfigSnapshot, 1)}
+	return &Server{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		CfgMgr: w,
+	}, w
+}
+
+// TestProcess_SubsequentRequestsDontNeedNode guards against the bug where
+// every DiscoveryRequest (not just the first) was required to carry a Node,
+// which would tear the stream down on Envoy's very first ACK.
+func TestProcess_SubsequentRequestsDontNeedNode(t *testing.T) {
+	srv, w := testServer()
+	stream := newFakeStream()
+
+	stream.reqs <- &envoy_api_v2.DiscoveryRequest{
+		Node:    &envoy_api_v2_core.Node{Id: "web-sidecar-proxy"},
+		TypeUrl: ClusterType,
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.process(stream) }()
+
+	// Deliver a snapshot so process has something to respond to and the ACK
+	// below has a nonce to match against.
+	w.ch <- &proxycfg.ConfigSnapshot{ProxyID: "web-sidecar-proxy"}
+
+	waitForSend(t, stream, 1)
+	nonce := stream.sent[0].Nonce
+
+	// A real ACK: same type URL, no Node, the nonce we just sent.
+	stream.reqs <- &envoy_api_v2.DiscoveryRequest{
+		TypeUrl:       ClusterType,
+		ResponseNonce: nonce,
+	}
+	close(stream.reqs)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("process returned an error for a nodeless ACK: %s", err)
+		}
+	case <-timeoutCh():
+		t.Fatalf("process didn't return after stream closed")
+	}
+
+	if w.proxyIDGot != "web-sidecar-proxy" {
+		t.Fatalf("got proxy ID %q, want web-sidecar-proxy", w.proxyIDGot)
+	}
+}
+
+// TestProcess_OnlySendsSubscribedTypes guards against pushing resource types
+// Envoy never asked for - in particular RDS, which routesFromSnapshot always
+// returns empty today, so a client that only requested CDS should never see
+// an EDS/LDS/RDS response even though the snapshot could produce EDS and LDS
+// too.
+func TestProcess_OnlySendsSubscribedTypes(t *testing.T) {
+	srv, w := testServer()
+	stream := newFakeStream()
+
+	stream.reqs <- &envoy_api_v2.DiscoveryRequest{
+		Node:    &envoy_api_v2_core.Node{Id: "web-sidecar-proxy"},
+		TypeUrl: ClusterType,
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.process(stream) }()
+
+	w.ch <- &proxycfg.ConfigSnapshot{ProxyID: "web-sidecar-proxy"}
+	waitForSend(t, stream, 1)
+
+	close(stream.reqs)
+	select {
+	case <-done:
+	case <-timeoutCh():
+		t.Fatalf("process didn't return after stream closed")
+	}
+
+	if len(stream.sent) != 1 {
+		t.Fatalf("got %d responses, want exactly 1 (only the subscribed CDS type)", len(stream.sent))
+	}
+	if stream.sent[0].TypeUrl != ClusterType {
+		t.Fatalf("got response for %s, want %s", stream.sent[0].TypeUrl, ClusterType)
+	}
+}
+
+// TestProcess_MissingNodeOnFirstRequest verifies the first request of a
+// stream still must carry a Node - only later ACK/NACKs are allowed to omit
+// it.
+func TestProcess_MissingNodeOnFirstRequest(t *testing.T) {
+	srv, _ := testServer()
+	stream := newFakeStream()
+
+	stream.reqs <- &envoy_api_v2.DiscoveryRequest{TypeUrl: ClusterType}
+	close(stream.reqs)
+
+	if err := srv.process(stream); err == nil {
+		t.Fatalf("expected an error for a first request with no node id")
+	}
+}